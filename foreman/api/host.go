@@ -3,12 +3,76 @@ package api
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/wayfair/terraform-provider-utils/log"
 )
 
+// httpStatusPattern does a best-effort scan for an HTTP status code
+// embedded in a raw error string, since SendAndParse only ever surfaces a
+// stringly typed error rather than the structured response metadata.
+var httpStatusPattern = regexp.MustCompile(`\b([1-5][0-9]{2})\b`)
+
+// extractHTTPStatus pulls the first HTTP-looking status code out of a raw
+// error message, or 0 if none is found.
+func extractHTTPStatus(msg string) int {
+	match := httpStatusPattern.FindStringSubmatch(msg)
+	if match == nil {
+		return 0
+	}
+	status, convErr := strconv.Atoi(match[1])
+	if convErr != nil {
+		return 0
+	}
+	return status
+}
+
+// Sentinel errors returned by SendBMCCommand, CreateHost and UpdateHost once
+// a Foreman or smart-proxy error from SendAndParse has been classified by
+// classifyBMCError. Callers can compare against
+// these with errors.Is instead of pattern-matching error strings themselves.
+var (
+	// ErrBMCColdResetRequired indicates the BMC refuses further commands
+	// until it receives a cold reset (e.g. IPMI completion code 0xD5).
+	ErrBMCColdResetRequired = errors.New("bmc cold reset required")
+	// ErrHostPowercycleRequired indicates the host itself must be
+	// power-cycled before the requested operation can complete.
+	ErrHostPowercycleRequired = errors.New("host powercycle required")
+	// ErrSessionExpired indicates the Client's session/auth token has
+	// expired and must be renewed before retrying.
+	ErrSessionExpired = errors.New("bmc session expired")
+)
+
+// classifyBMCError inspects a raw error returned from Foreman/smart-proxy
+// and maps known BMC sentinel conditions onto typed sentinel errors so
+// retry loops can react appropriately instead of blindly re-sending the
+// identical request.
+func classifyBMCError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "0xD5"), strings.Contains(msg, "cold reset"):
+		return ErrBMCColdResetRequired
+	case strings.Contains(msg, "session token expired"),
+		strings.Contains(msg, "session expired"),
+		strings.Contains(msg, "401 Unauthorized"):
+		return ErrSessionExpired
+	case strings.Contains(msg, "powercycle required"), strings.Contains(msg, "power cycle required"):
+		return ErrHostPowercycleRequired
+	default:
+		return err
+	}
+}
+
 const (
 	// HostEndpointPrefix : Prefix appended to API url for hosts
 	HostEndpointPrefix = "hosts"
@@ -34,6 +98,25 @@ const (
 	BmcBootPxe = "pxe"
 	// BmcPowerBios : Boot to BIOS
 	BmcPowerBios = "bios"
+	// ServicingSuffix : Suffix appended to API url for servicing operations
+	ServicingSuffix = "service"
+	// ServicingStateAvailable : Host is not under servicing and can be used
+	ServicingStateAvailable = "available"
+	// ServicingStateServicing : Host is actively running servicing steps
+	ServicingStateServicing = "servicing"
+	// ServicingStateServiceFailed : Host failed one or more servicing steps
+	ServicingStateServiceFailed = "service_failed"
+	// servicePollInterval : Delay between polls while waiting for a host to
+	// reach a terminal servicing state. Servicing runs asynchronously on
+	// the server side and can take anywhere from seconds to minutes, so
+	// polling without a delay would just burn through retryCount instantly.
+	servicePollInterval = 5 * time.Second
+	// BmcBootVirtualMedia : Boot to attached virtual media
+	BmcBootVirtualMedia = "virtual_media"
+	// BmcBootVirtualCD : Attach virtual media as a virtual CD
+	BmcBootVirtualCD = "cd"
+	// BmcBootVirtualUSB : Attach virtual media as a virtual USB drive
+	BmcBootVirtualUSB = "usb"
 )
 
 // -----------------------------------------------------------------------------
@@ -75,6 +158,26 @@ type ForemanHost struct {
 	Managed bool `json:"managed"`
 	// Nested struct defining any interfaces associated with the Host
 	InterfacesAttributes []ForemanInterfacesAttribute `json:"interfaces_attributes"`
+	// Current state of any day-2 servicing workflow running against this
+	// host. One of "available", "servicing", or "service_failed".
+	ServicingState string `json:"servicing_state,omitempty"`
+}
+
+// ServiceStep represents a single step of a servicing workflow, mirroring
+// Ironic clean/service step semantics. Steps are executed in ascending
+// Priority order by the Foreman/Ironic-backed service driver.
+type ServiceStep struct {
+	Interface string                 `json:"interface"`
+	Step      string                 `json:"step"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+	Priority  int                    `json:"priority,omitempty"`
+}
+
+// ServicingData is the manifest submitted to a host's service endpoint to
+// drive day-2 operations (firmware settings, RAID configuration, manual
+// cleaning) without reprovisioning the host.
+type ServicingData struct {
+	ServicingSteps []ServiceStep `json:"servicing_steps"`
 }
 
 // ForemanInterfacesAttribute representing a hosts defined network interfaces
@@ -129,6 +232,31 @@ type BMCBoot struct {
 	} `json:"boot,omitempty"`
 }
 
+// BMCVirtualMedia struct used for marshal/unmarshal of BMC virtual media
+// boot operations. Attaching a VirtualMediaImage boots the host from an
+// ephemeral live-ISO (rescue, diagnostics, firmware flashers) without
+// touching the host's disk. Leave Image nil to detach any attached media.
+type BMCVirtualMedia struct {
+	Device string             `json:"device,omitempty"`
+	Image  *VirtualMediaImage `json:"image,omitempty"`
+}
+
+// VirtualMediaImage describes the ISO/image presented to a host's BMC as
+// virtual media.
+type VirtualMediaImage struct {
+	URL string `json:"url"`
+	// Checksum of the image referenced by URL, verified by the BMC before
+	// attaching
+	Checksum string `json:"checksum,omitempty"`
+	// Algorithm used to compute Checksum (e.g. "md5", "sha256")
+	ChecksumType string `json:"checksum_type,omitempty"`
+	// Media type to present the image as. Must be one of BmcBootVirtualCD
+	// or BmcBootVirtualUSB
+	MediaType string `json:"media_type"`
+	// Whether the attached media should be presented as write-protected
+	WriteProtected bool `json:"write_protected"`
+}
+
 // Implement the Marshaler interface
 func (fh ForemanHost) MarshalJSON() ([]byte, error) {
 	log.Tracef("foreman/api/host.go#MarshalJSON")
@@ -223,19 +351,58 @@ func (fh *ForemanHost) UnmarshalJSON(b []byte) error {
 	if fh.PXELoader, ok = fhMap["pxe_loader"].(string); !ok {
 		fh.PXELoader = ""
 	}
+	if fh.ServicingState, ok = fhMap["servicing_state"].(string); !ok {
+		fh.ServicingState = ""
+	}
 
 	return nil
 }
 
+// AttemptRecord captures the outcome of a single retry attempt made while
+// sending a BMC command, so callers can see exactly which attempt failed
+// and why instead of only the last error in the chain.
+type AttemptRecord struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Err          string    `json:"err,omitempty"`
+	HTTPStatus   int       `json:"http_status,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+}
+
+// BMCResult aggregates per-provider metadata about a SendBMCCommand call.
+// Foreman's smart-proxy may attempt a BMC command against multiple
+// providers (e.g. IPMI, then Redfish) before succeeding; BMCResult lets
+// callers distinguish which provider ultimately succeeded and why the
+// others failed instead of collapsing everything into a single error.
+type BMCResult struct {
+	// Name of the provider (host) that ultimately succeeded, if any
+	SuccessfulProvider string
+	// Every provider the command was attempted against, in order
+	ProvidersAttempted []string
+	// Providers that ultimately returned a successful connection/response
+	SuccessfulOpenConns []string
+	// Detail for why a connection/command attempt failed, keyed by
+	// provider name and attempt number (e.g. "host1 (attempt 2)")
+	FailedConnDetail map[string]string
+	// Chronological record of every retry attempt made
+	Attempts []AttemptRecord
+}
+
 // SendBMCCommand sends provided BMC Action and State to foreman.  This
 // performs an IPMI action against the provided host Expects BMCPower or
 // BMCBoot type struct populated with an action
 //
 // Example: https://<foreman>/api/hosts/<hostname>/boot
-func (c *Client) SendBMCCommand(h *ForemanHost, cmd interface{}, retryCount int) error {
+//
+// BMCVirtualMedia commands are also accepted and are sent to the boot
+// endpoint.
+func (c *Client) SendBMCCommand(h *ForemanHost, cmd interface{}, retryCount int) (*BMCResult, error) {
 	// Initialize suffix variable,
 	suffix := ""
 
+	result := &BMCResult{
+		FailedConnDetail: map[string]string{},
+	}
+
 	// Defines the suffix to append to the URL per operation type
 	// Switch-Case against interface type to determine URL suffix
 	switch v := cmd.(type) {
@@ -243,39 +410,89 @@ func (c *Client) SendBMCCommand(h *ForemanHost, cmd interface{}, retryCount int)
 		suffix = BmcPowerSuffix
 	case BMCBoot:
 		suffix = BmcBootSuffix
+	case BMCVirtualMedia:
+		suffix = BmcBootSuffix
 	default:
-		return fmt.Errorf("Invalid BMC Operation: [%v]", v)
+		return result, fmt.Errorf("Invalid BMC Operation: [%v]", v)
 	}
 
 	reqHost := fmt.Sprintf("/%s/%s/%s", HostEndpointPrefix, h.Name, suffix)
 
-	JSONBytes, jsonEncErr := json.Marshal(cmd)
-	if jsonEncErr != nil {
-		return jsonEncErr
+	// newReq (re)builds the BMC request. It must be called again after any
+	// re-authentication so the retried request carries fresh auth state
+	// instead of resending the same request object built before the
+	// Client re-authenticated.
+	newReq := func() (*http.Request, error) {
+		JSONBytes, jsonEncErr := json.Marshal(cmd)
+		if jsonEncErr != nil {
+			return nil, jsonEncErr
+		}
+		log.Debugf("JSONBytes: [%s]", JSONBytes)
+
+		return c.NewRequest(http.MethodPut, reqHost, bytes.NewBuffer(JSONBytes))
 	}
-	log.Debugf("JSONBytes: [%s]", JSONBytes)
 
-	req, reqErr := c.NewRequest(http.MethodPut, reqHost, bytes.NewBuffer(JSONBytes))
+	req, reqErr := newReq()
 	if reqErr != nil {
-		return reqErr
+		return result, reqErr
 	}
 
+	result.ProvidersAttempted = append(result.ProvidersAttempted, h.Name)
+
 	retry := 0
 	var sendErr error
 	// retry until the successful BMC Operation
 	// or until # of allowed retries is reached
 	for retry < retryCount {
 		log.Debugf("SendBMC: Retry #[%d]", retry)
-		sendErr = c.SendAndParse(req, &cmd)
+		attempt := AttemptRecord{Timestamp: time.Now()}
+		rawErr := c.SendAndParse(req, &cmd)
+		sendErr = classifyBMCError(rawErr)
 		if sendErr != nil {
+			attempt.Err = sendErr.Error()
+			if rawErr != nil {
+				// best-effort: SendAndParse only gives us a stringly typed
+				// error, so scrape what we can of the status/body out of it
+				// rather than leaving these zero-valued
+				attempt.HTTPStatus = extractHTTPStatus(rawErr.Error())
+				attempt.ResponseBody = rawErr.Error()
+			}
+			// keyed per-attempt (not just per-provider) so a later retry's
+			// failure detail doesn't clobber an earlier, possibly more
+			// informative one
+			result.FailedConnDetail[fmt.Sprintf("%s (attempt %d)", h.Name, retry+1)] = sendErr.Error()
+			result.Attempts = append(result.Attempts, attempt)
+
+			switch sendErr {
+			case ErrSessionExpired:
+				if authErr := c.Authenticate(); authErr != nil {
+					return result, authErr
+				}
+				// re-authenticating rebuilds the Client's auth state; the
+				// request itself must be rebuilt to pick it up before the
+				// next retry
+				if req, reqErr = newReq(); reqErr != nil {
+					return result, reqErr
+				}
+			case ErrBMCColdResetRequired:
+				if resetErr := c.ResetBMC(h); resetErr != nil {
+					return result, resetErr
+				}
+			case ErrHostPowercycleRequired:
+				return result, sendErr
+			}
+
 			retry++
 		} else {
+			result.Attempts = append(result.Attempts, attempt)
+			result.SuccessfulProvider = h.Name
+			result.SuccessfulOpenConns = append(result.SuccessfulOpenConns, h.Name)
 			break
 		}
 	}
 
 	if sendErr != nil {
-		return sendErr
+		return result, sendErr
 	}
 
 	// Type Assertion to access map fields for BMCPower and BMCBoot types
@@ -286,9 +503,128 @@ func (c *Client) SendBMCCommand(h *ForemanHost, cmd interface{}, retryCount int)
 
 	// Test BMC operation and return an error if result is false
 	if powerMap[BmcPowerSuffix] == false || bootMap[BmcBootSuffix]["result"] == false {
-		return fmt.Errorf("Failed BMC Power Operation")
+		return result, fmt.Errorf("Failed BMC Power Operation")
 	}
-	return nil
+	return result, nil
+}
+
+// ServiceHost drives a host through a Foreman/Ironic-backed servicing
+// workflow (firmware settings, RAID configuration, manual cleaning steps)
+// without reprovisioning the host. The supplied ServicingData is PUT to the
+// host's service endpoint, and the host's status is then polled until it
+// reaches ServicingStateAvailable or ServicingStateServiceFailed.
+func (c *Client) ServiceHost(h *ForemanHost, data ServicingData, retryCount int) error {
+	log.Tracef("foreman/api/host.go#ServiceHost")
+
+	reqEndpoint := fmt.Sprintf("/%s/%d/%s", HostEndpointPrefix, h.Id, ServicingSuffix)
+
+	dataJSONBytes, jsonEncErr := json.Marshal(data)
+	if jsonEncErr != nil {
+		return jsonEncErr
+	}
+	log.Debugf("servicingDataJSONBytes: [%s]", dataJSONBytes)
+
+	req, reqErr := c.NewRequest(
+		http.MethodPut,
+		reqEndpoint,
+		bytes.NewBuffer(dataJSONBytes),
+	)
+	if reqErr != nil {
+		return reqErr
+	}
+
+	if sendErr := c.SendAndParse(req, nil); sendErr != nil {
+		return sendErr
+	}
+
+	// poll the host until the servicing workflow reaches a terminal state
+	// or the allowed number of retries is exhausted
+	retry := 0
+	for retry < retryCount {
+		log.Debugf("ServiceHost: Retry #[%d]", retry)
+
+		if retry > 0 {
+			time.Sleep(servicePollInterval)
+		}
+
+		polledHost, readErr := c.ReadHost(h.Id)
+		if readErr != nil {
+			return readErr
+		}
+
+		switch polledHost.ServicingState {
+		case ServicingStateAvailable:
+			h.ServicingState = polledHost.ServicingState
+			return nil
+		case ServicingStateServiceFailed:
+			return fmt.Errorf("host [%s] failed servicing", h.Name)
+		}
+
+		retry++
+	}
+
+	return fmt.Errorf("timed out waiting for host [%s] to finish servicing", h.Name)
+}
+
+// ResetBMC issues a "bmc reset cold" action against a host's BMC. This is
+// used to recover a BMC that reported ErrBMCColdResetRequired and will not
+// accept further commands until it has been cold reset.
+func (c *Client) ResetBMC(h *ForemanHost) error {
+	log.Tracef("foreman/api/host.go#ResetBMC")
+
+	reqHost := fmt.Sprintf("/%s/%s/%s", HostEndpointPrefix, h.Name, BmcPowerSuffix)
+
+	cmd := struct {
+		Reset string `json:"reset"`
+	}{
+		Reset: "cold",
+	}
+
+	JSONBytes, jsonEncErr := json.Marshal(cmd)
+	if jsonEncErr != nil {
+		return jsonEncErr
+	}
+	log.Debugf("resetBMCJSONBytes: [%s]", JSONBytes)
+
+	req, reqErr := c.NewRequest(http.MethodPut, reqHost, bytes.NewBuffer(JSONBytes))
+	if reqErr != nil {
+		return reqErr
+	}
+
+	return c.SendAndParse(req, nil)
+}
+
+// AttachVirtualMedia attaches the supplied virtual media image to a host's
+// BMC and, once attached, issues a power cycle so the host boots from it.
+// This allows booting ephemeral live-ISO workloads (rescue, diagnostics,
+// firmware flashers) without touching the host's disk.
+func (c *Client) AttachVirtualMedia(h *ForemanHost, iso VirtualMediaImage, retryCount int) error {
+	log.Tracef("foreman/api/host.go#AttachVirtualMedia")
+
+	cmd := BMCVirtualMedia{
+		Device: BmcBootVirtualMedia,
+		Image:  &iso,
+	}
+
+	if _, sendErr := c.SendBMCCommand(h, cmd, retryCount); sendErr != nil {
+		return sendErr
+	}
+
+	_, cycleErr := c.SendBMCCommand(h, BMCPower{PowerAction: BmcPowerCycle}, retryCount)
+	return cycleErr
+}
+
+// DetachVirtualMedia detaches any virtual media currently attached to a
+// host's BMC.
+func (c *Client) DetachVirtualMedia(h *ForemanHost, retryCount int) error {
+	log.Tracef("foreman/api/host.go#DetachVirtualMedia")
+
+	cmd := BMCVirtualMedia{
+		Device: BmcBootVirtualMedia,
+	}
+
+	_, sendErr := c.SendBMCCommand(h, cmd, retryCount)
+	return sendErr
 }
 
 // -----------------------------------------------------------------------------
@@ -304,18 +640,25 @@ func (c *Client) CreateHost(h *ForemanHost, retryCount int) (*ForemanHost, error
 
 	reqEndpoint := fmt.Sprintf("/%s", HostEndpointPrefix)
 
-	hJSONBytes, jsonEncErr := json.Marshal(h)
-	if jsonEncErr != nil {
-		return nil, jsonEncErr
-	}
+	// newReq (re)builds the create request. It must be called again after
+	// any re-authentication so the retried request carries fresh auth
+	// state instead of resending the same request object built before the
+	// Client re-authenticated.
+	newReq := func() (*http.Request, error) {
+		hJSONBytes, jsonEncErr := json.Marshal(h)
+		if jsonEncErr != nil {
+			return nil, jsonEncErr
+		}
+		log.Debugf("hJSONBytes: [%s]", hJSONBytes)
 
-	log.Debugf("hJSONBytes: [%s]", hJSONBytes)
+		return c.NewRequest(
+			http.MethodPost,
+			reqEndpoint,
+			bytes.NewBuffer(hJSONBytes),
+		)
+	}
 
-	req, reqErr := c.NewRequest(
-		http.MethodPost,
-		reqEndpoint,
-		bytes.NewBuffer(hJSONBytes),
-	)
+	req, reqErr := newReq()
 	if reqErr != nil {
 		return nil, reqErr
 	}
@@ -328,8 +671,18 @@ func (c *Client) CreateHost(h *ForemanHost, retryCount int) (*ForemanHost, error
 	// or until # of allowed retries is reached
 	for retry < retryCount {
 		log.Debugf("CreatedHost: Retry #[%d]", retry)
-		sendErr = c.SendAndParse(req, &createdHost)
+		sendErr = classifyBMCError(c.SendAndParse(req, &createdHost))
 		if sendErr != nil {
+			if sendErr == ErrSessionExpired {
+				if authErr := c.Authenticate(); authErr != nil {
+					return nil, authErr
+				}
+				if req, reqErr = newReq(); reqErr != nil {
+					return nil, reqErr
+				}
+			} else if sendErr == ErrHostPowercycleRequired {
+				return nil, sendErr
+			}
 			retry++
 		} else {
 			break
@@ -380,18 +733,25 @@ func (c *Client) UpdateHost(h *ForemanHost, retryCount int) (*ForemanHost, error
 
 	reqEndpoint := fmt.Sprintf("/%s/%d", HostEndpointPrefix, h.Id)
 
-	hJSONBytes, jsonEncErr := json.Marshal(h)
-	if jsonEncErr != nil {
-		return nil, jsonEncErr
-	}
+	// newReq (re)builds the update request. It must be called again after
+	// any re-authentication so the retried request carries fresh auth
+	// state instead of resending the same request object built before the
+	// Client re-authenticated.
+	newReq := func() (*http.Request, error) {
+		hJSONBytes, jsonEncErr := json.Marshal(h)
+		if jsonEncErr != nil {
+			return nil, jsonEncErr
+		}
+		log.Debugf("hostJSONBytes: [%s]", hJSONBytes)
 
-	log.Debugf("hostJSONBytes: [%s]", hJSONBytes)
+		return c.NewRequest(
+			http.MethodPut,
+			reqEndpoint,
+			bytes.NewBuffer(hJSONBytes),
+		)
+	}
 
-	req, reqErr := c.NewRequest(
-		http.MethodPut,
-		reqEndpoint,
-		bytes.NewBuffer(hJSONBytes),
-	)
+	req, reqErr := newReq()
 	if reqErr != nil {
 		return nil, reqErr
 	}
@@ -403,8 +763,18 @@ func (c *Client) UpdateHost(h *ForemanHost, retryCount int) (*ForemanHost, error
 	// or until # of allowed retries is reached
 	for retry < retryCount {
 		log.Debugf("UpdateHost: Retry #[%d]", retry)
-		sendErr = c.SendAndParse(req, &updatedHost)
+		sendErr = classifyBMCError(c.SendAndParse(req, &updatedHost))
 		if sendErr != nil {
+			if sendErr == ErrSessionExpired {
+				if authErr := c.Authenticate(); authErr != nil {
+					return nil, authErr
+				}
+				if req, reqErr = newReq(); reqErr != nil {
+					return nil, reqErr
+				}
+			} else if sendErr == ErrHostPowercycleRequired {
+				return nil, sendErr
+			}
 			retry++
 		} else {
 			break
@@ -0,0 +1,447 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wayfair/terraform-provider-utils/log"
+)
+
+const (
+	// HostClusterEndpointPrefix : Prefix appended to API url for host clusters
+	HostClusterEndpointPrefix = "host_clusters"
+	// hostClusterMaxWorkers bounds how many members are provisioned
+	// concurrently so a large cluster does not overwhelm Foreman with
+	// simultaneous create requests.
+	hostClusterMaxWorkers = 5
+)
+
+// -----------------------------------------------------------------------------
+// Struct Definition and Helpers
+// -----------------------------------------------------------------------------
+
+// ForemanHostCluster groups multiple ForemanHost members under a single
+// logical unit with shared attributes (hostgroup, PXE loader, BMC
+// credentials, common interface templates) and per-member overrides. This
+// lets users declare "give me N identical bare-metal nodes" as one resource
+// instead of copy-pasting foreman_host blocks.
+type ForemanHostCluster struct {
+	// Inherits the base object's attributes
+	ForemanObject
+
+	// ID of the hostgroup shared by every member of the cluster
+	HostgroupId int `json:"hostgroup_id"`
+	// PXE loader shared by every member of the cluster
+	PXELoader string `json:"pxe_loader"`
+	// BMC username shared by every member of the cluster
+	BMCUsername string `json:"bmc_username,omitempty"`
+	// BMC password shared by every member of the cluster
+	BMCPassword string `json:"bmc_password,omitempty"`
+	// Interface templates applied to every member that does not supply its
+	// own InterfacesAttributes override
+	InterfacesAttributes []ForemanInterfacesAttribute `json:"interfaces_attributes"`
+	// Members of the cluster. Each member is a full ForemanHost so it can
+	// override any of the cluster's shared attributes.
+	Members []ForemanHostClusterMember `json:"members"`
+}
+
+// ForemanHostClusterMember represents a single host within a
+// ForemanHostCluster along with any attributes that override the
+// cluster's shared defaults for that member.
+type ForemanHostClusterMember struct {
+	ForemanHost
+	// NOTE(ALL): mirrors the "_destroy" flag pattern already used by
+	//   ForemanInterfacesAttribute. Setting this to true on
+	//   UpdateHostCluster removes the member from the cluster (and deletes
+	//   the underlying host) instead of updating it in place.
+	Destroy bool `json:"_destroy,omitempty"`
+}
+
+// foremanHostClusterJSON struct used for JSON encode of the cluster's own
+// shared attributes on create/update.
+type foremanHostClusterJSON struct {
+	HostgroupId          int                          `json:"hostgroup_id"`
+	PXELoader            string                       `json:"pxe_loader"`
+	InterfacesAttributes []ForemanInterfacesAttribute `json:"interfaces_attributes"`
+}
+
+// foremanHostClusterReadJSON struct used for JSON decode of a host cluster.
+// Just like ForemanHost/foremanHostJSON, Foreman nests interfaces under the
+// key "interfaces" on read but expects "interfaces_attributes" on write, so
+// this is a distinct struct/tag from foremanHostClusterJSON rather than a
+// shared one. Member hosts are read separately via ReadHost.
+type foremanHostClusterReadJSON struct {
+	HostgroupId          int                          `json:"hostgroup_id"`
+	PXELoader            string                       `json:"pxe_loader"`
+	InterfacesAttributes []ForemanInterfacesAttribute `json:"interfaces"`
+	HostIds              []int                        `json:"host_ids"`
+}
+
+// bmcInterfaceType is the Foreman interface "type" used for a host's BMC
+// management interface. ForemanHostCluster.BMCUsername/BMCPassword are
+// applied only to interfaces of this type.
+const bmcInterfaceType = "bmc"
+
+// marshalHostClusterJSON wraps a foremanHostClusterJSON payload under the
+// "host_cluster" top-level key, matching the param-wrapping convention
+// Foreman expects of every other resource in this package (see
+// ForemanHost.MarshalJSON).
+func marshalHostClusterJSON(payload foremanHostClusterJSON) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"host_cluster": payload,
+	})
+}
+
+// applyHostClusterDefaults copies the cluster's shared attributes onto any
+// member that has not set its own value, so a member only needs to specify
+// the fields that differ from the rest of the cluster.
+func applyHostClusterDefaults(hc *ForemanHostCluster) {
+	for i := range hc.Members {
+		member := &hc.Members[i].ForemanHost
+		if member.HostgroupId == 0 {
+			member.HostgroupId = hc.HostgroupId
+		}
+		if member.PXELoader == "" {
+			member.PXELoader = hc.PXELoader
+		}
+		if len(member.InterfacesAttributes) == 0 {
+			// NOTE(ALL): copy, don't alias, the cluster's shared slice.
+			//   Every defaulted member would otherwise share one backing
+			//   array with each other and with hc.InterfacesAttributes
+			//   itself, so the per-member BMC credential mutation below
+			//   would silently clobber every other member's interfaces.
+			member.InterfacesAttributes = append([]ForemanInterfacesAttribute{}, hc.InterfacesAttributes...)
+		}
+
+		for j := range member.InterfacesAttributes {
+			iface := &member.InterfacesAttributes[j]
+			if iface.Type != bmcInterfaceType {
+				continue
+			}
+			if iface.Username == "" {
+				iface.Username = hc.BMCUsername
+			}
+			if iface.Password == "" {
+				iface.Password = hc.BMCPassword
+			}
+		}
+	}
+}
+
+// diffHostClusterMembers partitions a cluster's members into those that
+// need to be created (no ID yet), destroyed (flagged with the "_destroy"
+// convention and already provisioned), or updated in place (everything
+// else). A member flagged with "_destroy" that has no ID yet is dropped
+// from all three. It is kept pure/side-effect-free so UpdateHostCluster's
+// reconciliation logic can be unit tested without a live Client.
+func diffHostClusterMembers(members []ForemanHostClusterMember) (toCreate, toDestroy, toUpdate []ForemanHostClusterMember) {
+	for _, member := range members {
+		switch {
+		case member.Destroy && member.Id != 0:
+			toDestroy = append(toDestroy, member)
+		case member.Destroy:
+			// flagged for removal but never provisioned: nothing to do
+		case member.Id == 0:
+			toCreate = append(toCreate, member)
+		default:
+			toUpdate = append(toUpdate, member)
+		}
+	}
+	return toCreate, toDestroy, toUpdate
+}
+
+// -----------------------------------------------------------------------------
+// CRUD Implementation
+// -----------------------------------------------------------------------------
+
+// CreateHostCluster provisions every member of the supplied
+// ForemanHostCluster in parallel using a bounded worker pool, waits for each
+// member to finish building (Build == false), and rolls back any members
+// that already succeeded if another member fails to provision. The
+// returned ForemanHostCluster has its ID and member host references
+// populated from the result of the create operation.
+func (c *Client) CreateHostCluster(hc *ForemanHostCluster, retryCount int) (*ForemanHostCluster, error) {
+	log.Tracef("foreman/api/host_cluster.go#CreateHostCluster")
+
+	applyHostClusterDefaults(hc)
+
+	reqEndpoint := fmt.Sprintf("/%s", HostClusterEndpointPrefix)
+
+	hcJSONBytes, jsonEncErr := marshalHostClusterJSON(foremanHostClusterJSON{
+		HostgroupId:          hc.HostgroupId,
+		PXELoader:            hc.PXELoader,
+		InterfacesAttributes: hc.InterfacesAttributes,
+	})
+	if jsonEncErr != nil {
+		return nil, jsonEncErr
+	}
+	log.Debugf("hostClusterJSONBytes: [%s]", hcJSONBytes)
+
+	req, reqErr := c.NewRequest(http.MethodPost, reqEndpoint, bytes.NewBuffer(hcJSONBytes))
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	var createdCluster ForemanObject
+	if sendErr := c.SendAndParse(req, &createdCluster); sendErr != nil {
+		return nil, sendErr
+	}
+	hc.ForemanObject = createdCluster
+
+	createdHosts, createErr := c.createHostClusterMembers(hc.Members, retryCount)
+	if createErr != nil {
+		rollbackHostClusterMembers(c, createdHosts)
+		c.deleteHostClusterObject(hc.Id)
+		return nil, createErr
+	}
+
+	for i, createdHost := range createdHosts {
+		if waitErr := c.waitForHostBuildComplete(createdHost, retryCount); waitErr != nil {
+			rollbackHostClusterMembers(c, createdHosts)
+			c.deleteHostClusterObject(hc.Id)
+			return nil, waitErr
+		}
+		hc.Members[i].ForemanHost = *createdHost
+	}
+
+	log.Debugf("createdHostCluster: [%+v]", hc)
+
+	return hc, nil
+}
+
+// createHostClusterMembers creates every member host concurrently, bounded
+// by hostClusterMaxWorkers, and returns the created hosts in the same order
+// as the supplied members. If any member fails to create, the first error
+// encountered is returned alongside whichever members did succeed so the
+// caller can roll them back.
+func (c *Client) createHostClusterMembers(members []ForemanHostClusterMember, retryCount int) ([]*ForemanHost, error) {
+	var (
+		mutex        sync.Mutex
+		wg           sync.WaitGroup
+		firstErr     error
+		createdHosts = make([]*ForemanHost, len(members))
+		sem          = make(chan struct{}, hostClusterMaxWorkers)
+	)
+
+	for i := range members {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			member := members[idx].ForemanHost
+			createdHost, createErr := c.CreateHost(&member, retryCount)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if createErr != nil {
+				if firstErr == nil {
+					firstErr = createErr
+				}
+				return
+			}
+			createdHosts[idx] = createdHost
+		}(i)
+	}
+	wg.Wait()
+
+	return createdHosts, firstErr
+}
+
+// rollbackHostClusterMembers deletes any successfully created member hosts
+// so that a failed CreateHostCluster/UpdateHostCluster never leaves the
+// caller with a partially provisioned cluster.
+func rollbackHostClusterMembers(c *Client, createdHosts []*ForemanHost) {
+	for _, createdHost := range createdHosts {
+		if createdHost == nil {
+			continue
+		}
+		if delErr := c.DeleteHost(createdHost.Id); delErr != nil {
+			log.Debugf(
+				"rollbackHostClusterMembers: failed to delete host [%d]: [%s]",
+				createdHost.Id,
+				delErr,
+			)
+		}
+	}
+}
+
+// deleteHostClusterObject removes the cluster object itself, ignoring (but
+// logging) any error. Used to clean up after a failed CreateHostCluster so
+// a partially provisioned cluster doesn't leave behind an orphaned,
+// memberless cluster record that Terraform has no ID to ever target again.
+func (c *Client) deleteHostClusterObject(id int) {
+	reqEndpoint := fmt.Sprintf("/%s/%d", HostClusterEndpointPrefix, id)
+
+	req, reqErr := c.NewRequest(http.MethodDelete, reqEndpoint, nil)
+	if reqErr != nil {
+		log.Debugf("deleteHostClusterObject: failed to build delete request for cluster [%d]: [%s]", id, reqErr)
+		return
+	}
+	if sendErr := c.SendAndParse(req, nil); sendErr != nil {
+		log.Debugf("deleteHostClusterObject: failed to delete cluster [%d]: [%s]", id, sendErr)
+	}
+}
+
+// waitForHostBuildComplete polls a host until it reports Build == false or
+// the allowed number of retries is reached.
+func (c *Client) waitForHostBuildComplete(h *ForemanHost, retryCount int) error {
+	retry := 0
+	for retry < retryCount {
+		if retry > 0 {
+			time.Sleep(servicePollInterval)
+		}
+
+		polledHost, readErr := c.ReadHost(h.Id)
+		if readErr != nil {
+			return readErr
+		}
+		if !polledHost.Build {
+			*h = *polledHost
+			return nil
+		}
+		retry++
+	}
+
+	return fmt.Errorf("timed out waiting for host [%s] to finish building", h.Name)
+}
+
+// ReadHostCluster reads the attributes of a ForemanHostCluster identified
+// by the supplied ID, along with every member host, and returns a
+// ForemanHostCluster reference.
+func (c *Client) ReadHostCluster(id int) (*ForemanHostCluster, error) {
+	log.Tracef("foreman/api/host_cluster.go#ReadHostCluster")
+
+	reqEndpoint := fmt.Sprintf("/%s/%d", HostClusterEndpointPrefix, id)
+
+	req, reqErr := c.NewRequest(http.MethodGet, reqEndpoint, nil)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	var clusterJSON foremanHostClusterReadJSON
+	if sendErr := c.SendAndParse(req, &clusterJSON); sendErr != nil {
+		return nil, sendErr
+	}
+
+	readCluster := ForemanHostCluster{
+		ForemanObject:        ForemanObject{Id: id},
+		HostgroupId:          clusterJSON.HostgroupId,
+		PXELoader:            clusterJSON.PXELoader,
+		InterfacesAttributes: clusterJSON.InterfacesAttributes,
+	}
+
+	for _, hostId := range clusterJSON.HostIds {
+		member, readErr := c.ReadHost(hostId)
+		if readErr != nil {
+			return nil, readErr
+		}
+		readCluster.Members = append(readCluster.Members, ForemanHostClusterMember{ForemanHost: *member})
+	}
+
+	log.Debugf("readHostCluster: [%+v]", readCluster)
+
+	return &readCluster, nil
+}
+
+// UpdateHostCluster updates a ForemanHostCluster's shared attributes and
+// reconciles its membership. Members present in the supplied cluster but
+// not yet provisioned are created; members flagged with Destroy (the same
+// "_destroy" convention used by ForemanInterfacesAttribute) are deleted;
+// all other members are updated in place. The supplied ForemanHostCluster
+// is updated in place to reflect the result of the update and returned.
+func (c *Client) UpdateHostCluster(hc *ForemanHostCluster, retryCount int) (*ForemanHostCluster, error) {
+	log.Tracef("foreman/api/host_cluster.go#UpdateHostCluster")
+
+	applyHostClusterDefaults(hc)
+
+	reqEndpoint := fmt.Sprintf("/%s/%d", HostClusterEndpointPrefix, hc.Id)
+
+	hcJSONBytes, jsonEncErr := marshalHostClusterJSON(foremanHostClusterJSON{
+		HostgroupId:          hc.HostgroupId,
+		PXELoader:            hc.PXELoader,
+		InterfacesAttributes: hc.InterfacesAttributes,
+	})
+	if jsonEncErr != nil {
+		return nil, jsonEncErr
+	}
+	log.Debugf("hostClusterJSONBytes: [%s]", hcJSONBytes)
+
+	req, reqErr := c.NewRequest(http.MethodPut, reqEndpoint, bytes.NewBuffer(hcJSONBytes))
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	if sendErr := c.SendAndParse(req, nil); sendErr != nil {
+		return nil, sendErr
+	}
+
+	toCreate, toDestroy, toUpdate := diffHostClusterMembers(hc.Members)
+
+	for _, member := range toDestroy {
+		if delErr := c.DeleteHost(member.Id); delErr != nil {
+			return nil, delErr
+		}
+	}
+
+	var toKeep []ForemanHostClusterMember
+	for _, member := range toUpdate {
+		updatedMember := member.ForemanHost
+		updatedHost, updateErr := c.UpdateHost(&updatedMember, retryCount)
+		if updateErr != nil {
+			return nil, updateErr
+		}
+		toKeep = append(toKeep, ForemanHostClusterMember{ForemanHost: *updatedHost})
+	}
+
+	createdHosts, createErr := c.createHostClusterMembers(toCreate, retryCount)
+	if createErr != nil {
+		rollbackHostClusterMembers(c, createdHosts)
+		return nil, createErr
+	}
+	for _, createdHost := range createdHosts {
+		if waitErr := c.waitForHostBuildComplete(createdHost, retryCount); waitErr != nil {
+			rollbackHostClusterMembers(c, createdHosts)
+			return nil, waitErr
+		}
+		toKeep = append(toKeep, ForemanHostClusterMember{ForemanHost: *createdHost})
+	}
+
+	hc.Members = toKeep
+
+	log.Debugf("updatedHostCluster: [%+v]", hc)
+
+	return hc, nil
+}
+
+// DeleteHostCluster deletes every member host of the ForemanHostCluster
+// identified by the supplied ID and then deletes the cluster itself.
+func (c *Client) DeleteHostCluster(id int) error {
+	log.Tracef("foreman/api/host_cluster.go#DeleteHostCluster")
+
+	cluster, readErr := c.ReadHostCluster(id)
+	if readErr != nil {
+		return readErr
+	}
+
+	for _, member := range cluster.Members {
+		if delErr := c.DeleteHost(member.Id); delErr != nil {
+			return delErr
+		}
+	}
+
+	reqEndpoint := fmt.Sprintf("/%s/%d", HostClusterEndpointPrefix, id)
+
+	req, reqErr := c.NewRequest(http.MethodDelete, reqEndpoint, nil)
+	if reqErr != nil {
+		return reqErr
+	}
+
+	return c.SendAndParse(req, nil)
+}
@@ -0,0 +1,94 @@
+package api
+
+import "testing"
+
+func TestApplyHostClusterDefaults(t *testing.T) {
+	hc := &ForemanHostCluster{
+		HostgroupId: 10,
+		PXELoader:   "Grub2 UEFI",
+		BMCUsername: "admin",
+		BMCPassword: "secret",
+		InterfacesAttributes: []ForemanInterfacesAttribute{
+			{Type: bmcInterfaceType, Identifier: "bmc0"},
+		},
+		Members: []ForemanHostClusterMember{
+			{ForemanHost: ForemanHost{}},
+			{ForemanHost: ForemanHost{}},
+			{ForemanHost: ForemanHost{HostgroupId: 99, PXELoader: "iPXE Embedded"}},
+		},
+	}
+
+	applyHostClusterDefaults(hc)
+
+	for i, member := range hc.Members[:2] {
+		if member.HostgroupId != 10 {
+			t.Errorf("member [%d]: expected defaulted HostgroupId 10, got [%d]", i, member.HostgroupId)
+		}
+		if member.PXELoader != "Grub2 UEFI" {
+			t.Errorf("member [%d]: expected defaulted PXELoader, got [%s]", i, member.PXELoader)
+		}
+		if len(member.InterfacesAttributes) != 1 || member.InterfacesAttributes[0].Username != "admin" {
+			t.Fatalf("member [%d]: expected defaulted bmc interface with cluster username, got [%+v]", i, member.InterfacesAttributes)
+		}
+	}
+
+	if hc.Members[2].HostgroupId != 99 || hc.Members[2].PXELoader != "iPXE Embedded" {
+		t.Errorf("member-supplied override should not be replaced by cluster default, got [%+v]", hc.Members[2])
+	}
+
+	// Regression test: defaulted members must not alias the cluster's
+	// shared InterfacesAttributes backing array (or each other's).
+	if &hc.Members[0].InterfacesAttributes[0] == &hc.Members[1].InterfacesAttributes[0] {
+		t.Fatal("expected defaulted members to each get their own interfaces slice, not a shared one")
+	}
+
+	hc.Members[0].InterfacesAttributes[0].Username = "member0-only"
+	if hc.Members[1].InterfacesAttributes[0].Username != "admin" {
+		t.Fatalf("expected member 1's interface to be unaffected by member 0's mutation, got [%s]", hc.Members[1].InterfacesAttributes[0].Username)
+	}
+	if hc.InterfacesAttributes[0].Username != "" {
+		t.Fatalf("expected cluster template interface to be unaffected by member mutation, got [%s]", hc.InterfacesAttributes[0].Username)
+	}
+}
+
+func TestApplyHostClusterDefaultsSkipsNonBMCInterfaces(t *testing.T) {
+	hc := &ForemanHostCluster{
+		BMCUsername: "admin",
+		BMCPassword: "secret",
+		InterfacesAttributes: []ForemanInterfacesAttribute{
+			{Type: "interface", Identifier: "eth0"},
+		},
+		Members: []ForemanHostClusterMember{
+			{ForemanHost: ForemanHost{}},
+		},
+	}
+
+	applyHostClusterDefaults(hc)
+
+	iface := hc.Members[0].InterfacesAttributes[0]
+	if iface.Username != "" || iface.Password != "" {
+		t.Fatalf("expected BMC creds to be left unset on a non-bmc interface, got [%+v]", iface)
+	}
+}
+
+func TestDiffHostClusterMembers(t *testing.T) {
+	newMember := ForemanHostClusterMember{ForemanHost: ForemanHost{}}
+	existingMember := ForemanHostClusterMember{ForemanHost: ForemanHost{ForemanObject: ForemanObject{Id: 1}}}
+	destroyedMember := ForemanHostClusterMember{ForemanHost: ForemanHost{ForemanObject: ForemanObject{Id: 2}}, Destroy: true}
+
+	toCreate, toDestroy, toUpdate := diffHostClusterMembers([]ForemanHostClusterMember{
+		newMember,
+		existingMember,
+		destroyedMember,
+	})
+
+	if len(toCreate) != 1 || toCreate[0].Id != 0 {
+		t.Fatalf("expected exactly the id-less member in toCreate, got [%+v]", toCreate)
+	}
+	if len(toUpdate) != 1 || toUpdate[0].Id != 1 {
+		t.Fatalf("expected exactly the existing, non-destroyed member in toUpdate, got [%+v]", toUpdate)
+	}
+	if len(toDestroy) != 1 || toDestroy[0].Id != 2 {
+		t.Fatalf("expected exactly the destroy-flagged member in toDestroy, got [%+v]", toDestroy)
+	}
+}
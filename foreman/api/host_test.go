@@ -0,0 +1,60 @@
+package api
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassifyBMCError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want error // expected sentinel; nil means err should pass through unchanged
+	}{
+		{"nil error passes through", nil, nil},
+		{"ipmi 0xD5 completion code maps to cold reset", errors.New("ipmi completion code 0xD5"), ErrBMCColdResetRequired},
+		{"cold reset phrase maps to cold reset", errors.New("bmc requires a cold reset"), ErrBMCColdResetRequired},
+		{"session token expired maps to session expired", errors.New("session token expired"), ErrSessionExpired},
+		{"session expired phrase maps to session expired", errors.New("session expired, please retry"), ErrSessionExpired},
+		{"401 Unauthorized anchored maps to session expired", errors.New("smart-proxy returned 401 Unauthorized"), ErrSessionExpired},
+		{"bare 401 does not map to session expired", errors.New("host id 401 was not found"), nil},
+		{"powercycle required maps to powercycle sentinel", errors.New("host powercycle required to continue"), ErrHostPowercycleRequired},
+		{"unrelated error passes through unchanged", errors.New("connection refused"), nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := classifyBMCError(tc.err)
+			if tc.want != nil {
+				if got != tc.want {
+					t.Fatalf("expected sentinel [%v], got [%v]", tc.want, got)
+				}
+				return
+			}
+			if got != tc.err {
+				t.Fatalf("expected original error [%v] to pass through unchanged, got [%v]", tc.err, got)
+			}
+		})
+	}
+}
+
+func TestExtractHTTPStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  string
+		want int
+	}{
+		{"extracts a trailing status code", "request failed: 404 Not Found", 404},
+		{"extracts the first http-looking code", "status 503 after 3 retries", 503},
+		{"returns zero when no status present", "connection refused", 0},
+		{"ignores numbers outside the http status range", "retried 999 times", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extractHTTPStatus(tc.msg); got != tc.want {
+				t.Fatalf("expected [%d], got [%d]", tc.want, got)
+			}
+		})
+	}
+}